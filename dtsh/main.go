@@ -4,7 +4,7 @@ import "bufio"
 import "fmt"
 import "os"
 
-import "github.com/ferbivore/dtsh"
+import dtsh "github.com/ferbivore/dtsh/libdtsh"
 
 func main() {
 	fmt.Printf("> ")
@@ -19,6 +19,26 @@ func main() {
 				fmt.Printf(" reg ")
 			case dtsh.TokenLiteral:
 				fmt.Printf(" lit ")
+			case dtsh.TokenPipe:
+				fmt.Printf(" pipe ")
+			case dtsh.TokenAnd:
+				fmt.Printf(" and ")
+			case dtsh.TokenOr:
+				fmt.Printf(" or ")
+			case dtsh.TokenSemicolon:
+				fmt.Printf(" semi ")
+			case dtsh.TokenBackground:
+				fmt.Printf(" bg ")
+			case dtsh.TokenRedirIn:
+				fmt.Printf(" redirin ")
+			case dtsh.TokenRedirOut:
+				fmt.Printf(" redirout ")
+			case dtsh.TokenRedirAppend:
+				fmt.Printf(" redirappend ")
+			case dtsh.TokenSubshell:
+				fmt.Printf(" subshell ")
+			case dtsh.TokenComment:
+				fmt.Printf(" comment ")
 			}
 			fmt.Println(token.Value)
 		}
@@ -0,0 +1,774 @@
+package dtsh
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// There are two types of tokens that dtsh needs to be aware of: regular tokens,
+// which are either words or strings delimited by double quotes, and literal
+// tokens, which are strings delimited by single quotes. The reason we need to
+// distinguish between them is that variable substitution is not allowed inside
+// literal tokens. See TokenizeWithEnv and Lexer.Env for where that substitution
+// happens for the other two token types.
+type TokenType int
+
+const (
+    TokenRegular TokenType = iota
+    TokenLiteral
+    TokenPipe         // |
+    TokenAnd          // &&
+    TokenOr           // ||
+    TokenSemicolon    // ;
+    TokenBackground   // &
+    TokenRedirIn      // <
+    TokenRedirOut     // >
+    TokenRedirAppend  // >>
+    TokenSubshell     // `...` or $(...); Value holds the inner command text
+    TokenComment      // # ...; Value holds the comment text after the '#'
+)
+
+// Position identifies a rune's line and column in the input, both 1-indexed.
+type Position struct {
+    Line   int
+    Column int
+}
+
+func (p Position) String() string {
+    return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Tokens are a string, a TokenType, and the position the token started at.
+type Token struct {
+    Type  TokenType
+    Value string
+    Pos   Position
+}
+
+// Write out the string inside the Token.
+func (t Token) String() string {
+    return t.Value
+}
+
+// LexError is returned by Lexer.Next when the input can't be tokenized, e.g.
+// because of an unterminated quote or a bad escape sequence.
+type LexError struct {
+    Pos Position
+    Msg string
+}
+
+func (e *LexError) Error() string {
+    return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// Tokenize takes an input and splits it into tokens. It's modeled as a state
+// machine with five states.
+//
+//  stateWhitespace -> (double quote) -> stateString
+//                     (single quote) -> stateLiteral
+//                     (whitespace)   -> stateWhitespace
+//                     (character)    -> character pushed
+//                                       stateWord
+//
+//  stateWord -> (whitespace)   -> token pushed and cleared
+//                                 stateWhitespace
+//               (double quote) -> stateString
+//               (single quote) -> stateLiteral
+//               (backslash)    -> save state to lastState
+//                                 stateBackslash
+//               (character)    -> character pushed
+//
+//  stateString -> (double quote) -> token pushed and cleared
+//                                   stateWhitespace (?)
+//                 (backslash)    -> save state to lastState
+//                                   stateBackslash
+//                 (character)    -> character pushed
+//
+//  stateLiteral -> (single quote) -> token pushed and cleared
+//                                    stateWhitespace (?)
+//                  (backslash)    -> save state to lastState
+//                                    stateBackslash
+//                  (character)    -> character pushed
+//
+//  stateBackslash -> n           -> \n pushed
+//                                   lastState
+//                    r           -> \r pushed
+//                                   lastState
+//                    t           -> \t pushed
+//                                   lastState
+//                    b           -> \b pushed
+//                                   lastState
+//                    f           -> \f pushed
+//                                   lastState
+//                    v           -> \v pushed
+//                                   lastState
+//                    x           -> 2 hex digits read, rune pushed
+//                                   lastState
+//                    u           -> 4 hex digits read, rune pushed
+//                                   lastState
+//                    U           -> 8 hex digits read, rune pushed
+//                                   lastState
+//                    0           -> 3 octal digits read, rune pushed
+//                                   lastState
+//                    (character) -> character pushed
+//                                   lastState
+//
+// Outside of stateString and stateLiteral, the shell operators |, &&, ||, ;,
+// &, <, >, and >> are recognized as their own tokens (TokenPipe and friends),
+// as are `...` and $(...) subshell spans (TokenSubshell). Encountering one of
+// these while stateWord has a token in progress ends that token first, so
+// "foo|bar" still tokenizes as "foo", TokenPipe, "bar" with no space needed.
+//
+// Tokenize is built on top of Lexer: it reads tokens until Next returns an
+// error, and silently drops whatever token was in progress at that point, the
+// same way the original hand-rolled implementation did. Callers that need to
+// know about unterminated quotes or bad escapes should use a Lexer directly.
+func Tokenize(s string) []Token {
+    lex := NewLexer(strings.NewReader(s))
+    var tokens []Token
+    for {
+        tok, err := lex.Next()
+        if err != nil {
+            break
+        }
+        tokens = append(tokens, tok)
+    }
+    return tokens
+}
+
+// TokenizeWithEnv behaves like Tokenize, but expands $NAME, ${NAME}, and $?
+// references found in regular and double-quoted tokens by calling env with
+// the referenced name. Literal (single-quoted) tokens are passed through
+// unexpanded. An expansion that env reports as absent, or that resolves to
+// the empty string, contributes nothing to the token rather than dropping
+// the token itself; see Lexer.Env for the expansion rules.
+func TokenizeWithEnv(s string, env func(name string) (string, bool)) []Token {
+    lex := NewLexer(strings.NewReader(s))
+    lex.Env = env
+    var tokens []Token
+    for {
+        tok, err := lex.Next()
+        if err != nil {
+            break
+        }
+        tokens = append(tokens, tok)
+    }
+    return tokens
+}
+
+type lexState int
+
+const (
+    lexWhitespace lexState = iota
+    lexWord
+    lexString
+    lexLiteral
+    lexBackslash
+)
+
+// Lexer turns an io.Reader into a stream of Tokens, one at a time. Unlike
+// Tokenize, it reports unterminated quotes and bad escape sequences as errors
+// instead of swallowing the rest of the input.
+type Lexer struct {
+    r    *bufio.Reader
+    line int
+    col  int
+
+    state      lexState
+    lastState  lexState
+    token      []rune
+    tokenStart Position
+    pending    *Token
+
+    // Env, if set, is consulted for $NAME, ${NAME}, and $? references found
+    // while building regular or double-quoted tokens; "?" is the name used
+    // for $?. It's never consulted inside single-quoted (literal) tokens.
+    // A missing name, signalled by a false second return value, expands to
+    // the empty string, same as a name whose value is the empty string.
+    // Leaving Env nil (the default) disables substitution and treats '$' as
+    // an ordinary character, matching Tokenize's behavior.
+    Env func(name string) (string, bool)
+
+    // IgnoreComments, if true, makes Next skip over comment tokens instead of
+    // returning them, so callers that don't care about comments don't have
+    // to filter TokenComment out themselves. It's false by default, matching
+    // Tokenize's behavior of returning every token it sees.
+    IgnoreComments bool
+}
+
+// NewLexer wraps r in a Lexer, ready to produce tokens from its contents.
+func NewLexer(r io.Reader) *Lexer {
+    return &Lexer{
+        r:    bufio.NewReader(r),
+        line: 1,
+        col:  1,
+    }
+}
+
+// pos returns the position of the rune that's about to be read.
+func (l *Lexer) pos() Position {
+    return Position{Line: l.line, Column: l.col}
+}
+
+// readRune reads the next rune and advances the line/column counters. ok is
+// false at end of input.
+func (l *Lexer) readRune() (rune, bool, error) {
+    char, _, err := l.r.ReadRune()
+    if err == io.EOF {
+        return 0, false, nil
+    }
+    if err != nil {
+        return 0, false, err
+    }
+    if char == '\n' {
+        l.line++
+        l.col = 1
+    } else {
+        l.col++
+    }
+    return char, true, nil
+}
+
+// unreadRune undoes the most recent readRune, restoring the line/column
+// counters to what they were at pos. It must only be called once per
+// readRune, with the position readRune returned pos for.
+func (l *Lexer) unreadRune(pos Position) {
+    l.r.UnreadRune()
+    l.line = pos.Line
+    l.col = pos.Column
+}
+
+// isOperatorStart reports whether r can begin a shell operator token
+// (TokenPipe and friends).
+func isOperatorStart(r rune) bool {
+    _, ok := operatorTokens[r]
+    return ok
+}
+
+func isIdentStart(r rune) bool {
+    return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentChar(r rune) bool {
+    return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isHexDigit(r rune) bool {
+    return (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+func isOctalDigit(r rune) bool {
+    return r >= '0' && r <= '7'
+}
+
+// readDigits reads exactly n digits satisfying valid, used to parse the
+// fixed-width \x, \u, \U, and \0 escapes. start is the position of the
+// escape's introducing character (x, u, U, or 0), used for any error
+// reported. kind names the escape in error messages, e.g. `\x`.
+func (l *Lexer) readDigits(start Position, n int, valid func(rune) bool, kind string) (string, error) {
+    var digits []rune
+    for i := 0; i < n; i++ {
+        c, ok, err := l.readRune()
+        if err != nil {
+            return "", err
+        }
+        if !ok {
+            return "", &LexError{Pos: start, Msg: fmt.Sprintf("%s escape cut short: expected %d digits, got %d", kind, n, i)}
+        }
+        if !valid(c) {
+            return "", &LexError{Pos: start, Msg: fmt.Sprintf("%s escape: %q is not a valid digit", kind, c)}
+        }
+        digits = append(digits, c)
+    }
+    return string(digits), nil
+}
+
+// expandVar reads a variable reference immediately following a '$' (already
+// consumed by the caller) and returns its value via l.Env. start is the
+// position of the '$' itself, used for any error reported.
+func (l *Lexer) expandVar(start Position) (string, error) {
+    char, ok, err := l.readRune()
+    if err != nil {
+        return "", err
+    }
+    if !ok {
+        return "", &LexError{Pos: start, Msg: "bad variable reference: $ at end of input"}
+    }
+
+    var name string
+    switch {
+    case char == '?':
+        name = "?"
+    case char == '{':
+        var buf []rune
+        for {
+            c, ok, err := l.readRune()
+            if err != nil {
+                return "", err
+            }
+            if !ok {
+                return "", &LexError{Pos: start, Msg: "unterminated variable reference"}
+            }
+            if c == '}' {
+                break
+            }
+            buf = append(buf, c)
+        }
+        name = string(buf)
+    case isIdentStart(char):
+        buf := []rune{char}
+        for {
+            before := l.pos()
+            c, ok, err := l.readRune()
+            if err != nil {
+                return "", err
+            }
+            if !ok {
+                break
+            }
+            if !isIdentChar(c) {
+                l.unreadRune(before)
+                break
+            }
+            buf = append(buf, c)
+        }
+        name = string(buf)
+    default:
+        return "", &LexError{Pos: start, Msg: "bad variable reference"}
+    }
+
+    value, _ := l.Env(name)
+    return value, nil
+}
+
+// operatorTokens maps a leading operator rune to the TokenType it produces
+// on its own, and twoCharOperators maps two-rune operators to theirs. Both
+// are consulted by scanOperator, which always prefers the longest match so
+// that e.g. ">>" isn't split into two TokenRedirOut tokens.
+var operatorTokens = map[rune]TokenType{
+    '|': TokenPipe,
+    '&': TokenBackground,
+    ';': TokenSemicolon,
+    '<': TokenRedirIn,
+    '>': TokenRedirOut,
+}
+
+var twoCharOperators = map[[2]rune]TokenType{
+    {'&', '&'}: TokenAnd,
+    {'|', '|'}: TokenOr,
+    {'>', '>'}: TokenRedirAppend,
+}
+
+// scanOperator reads an operator token starting with first (already
+// consumed, at position start), preferring a two-rune match over a one-rune
+// one.
+func (l *Lexer) scanOperator(first rune, start Position) (Token, error) {
+    before := l.pos()
+    second, ok, err := l.readRune()
+    if err != nil {
+        return Token{}, err
+    }
+    if ok {
+        if tt, isTwoChar := twoCharOperators[[2]rune{first, second}]; isTwoChar {
+            return Token{Type: tt, Value: string([]rune{first, second}), Pos: start}, nil
+        }
+        l.unreadRune(before)
+    }
+    return Token{Type: operatorTokens[first], Value: string(first), Pos: start}, nil
+}
+
+// scanBacktick reads the contents of a `...` subshell span; start is the
+// position of the opening backtick, already consumed.
+func (l *Lexer) scanBacktick(start Position) (string, error) {
+    var buf []rune
+    for {
+        c, ok, err := l.readRune()
+        if err != nil {
+            return "", err
+        }
+        if !ok {
+            return "", &LexError{Pos: start, Msg: "unterminated subshell"}
+        }
+        if c == '`' {
+            return string(buf), nil
+        }
+        buf = append(buf, c)
+    }
+}
+
+// scanComment reads the rest of the current line as a comment; start is the
+// position of the '#', already consumed. The newline that ends the comment,
+// if any, is left unread so the following token's position is unaffected.
+func (l *Lexer) scanComment(start Position) (string, error) {
+    var buf []rune
+    for {
+        before := l.pos()
+        c, ok, err := l.readRune()
+        if err != nil {
+            return "", err
+        }
+        if !ok {
+            return string(buf), nil
+        }
+        if c == '\n' {
+            l.unreadRune(before)
+            return string(buf), nil
+        }
+        buf = append(buf, c)
+    }
+}
+
+// scanParenSubshell reads the contents of a $(...) subshell span; start is
+// the position of the '$', and the opening '(' has already been consumed.
+// Nested parentheses are balanced so inner command substitutions don't close
+// the span early.
+func (l *Lexer) scanParenSubshell(start Position) (string, error) {
+    var buf []rune
+    depth := 1
+    for {
+        c, ok, err := l.readRune()
+        if err != nil {
+            return "", err
+        }
+        if !ok {
+            return "", &LexError{Pos: start, Msg: "unterminated subshell"}
+        }
+        switch c {
+        case '(':
+            depth++
+        case ')':
+            depth--
+            if depth == 0 {
+                return string(buf), nil
+            }
+        }
+        buf = append(buf, c)
+    }
+}
+
+// dollarResult is what handleDollar found after a '$' outside of quotes:
+// either a command substitution ready to become a TokenSubshell, or text to
+// append to the token currently being built (a variable's expansion, or a
+// literal "$" when no Env is set).
+type dollarResult struct {
+    subshell  *Token
+    expansion string
+}
+
+// handleDollar processes a '$' (already consumed, at position start) found
+// in stateWhitespace or stateWord: $( introduces a subshell, anything else
+// is handled the way Lexer.Env describes.
+func (l *Lexer) handleDollar(start Position) (dollarResult, error) {
+    before := l.pos()
+    char, ok, err := l.readRune()
+    if err != nil {
+        return dollarResult{}, err
+    }
+    if ok && char == '(' {
+        inner, err := l.scanParenSubshell(start)
+        if err != nil {
+            return dollarResult{}, err
+        }
+        return dollarResult{subshell: &Token{Type: TokenSubshell, Value: inner, Pos: start}}, nil
+    }
+    if ok {
+        l.unreadRune(before)
+    }
+    if l.Env == nil {
+        return dollarResult{expansion: "$"}, nil
+    }
+    value, err := l.expandVar(start)
+    if err != nil {
+        return dollarResult{}, err
+    }
+    return dollarResult{expansion: value}, nil
+}
+
+// flushThen makes tok the next token returned, after first emitting whatever
+// token is currently being built, if any. It's used when an operator,
+// subshell, or background '&' is found mid-word, so "foo|bar" still produces
+// a "foo" token before the TokenPipe.
+func (l *Lexer) flushThen(tok Token) (Token, error) {
+    l.state = lexWhitespace
+    if len(l.token) > 0 {
+        word := l.emit(TokenRegular)
+        l.pending = &tok
+        return word, nil
+    }
+    return tok, nil
+}
+
+// push appends char to the token currently being built, recording its start
+// position the first time a character is pushed for it.
+func (l *Lexer) push(char rune, start Position) {
+    if len(l.token) == 0 {
+        l.tokenStart = start
+    }
+    l.token = append(l.token, char)
+}
+
+// emit turns the accumulated token into a Token, then clears it.
+func (l *Lexer) emit(t TokenType) Token {
+    tok := Token{Type: t, Value: string(l.token), Pos: l.tokenStart}
+    l.token = nil
+    return tok
+}
+
+// Next returns the next Token in the input. It returns io.EOF once the input
+// is exhausted, or a *LexError if the input can't be tokenized.
+func (l *Lexer) Next() (Token, error) {
+    if l.pending != nil {
+        tok := *l.pending
+        l.pending = nil
+        return tok, nil
+    }
+
+    for {
+        start := l.pos()
+        char, ok, err := l.readRune()
+        if err != nil {
+            return Token{}, err
+        }
+        if !ok {
+            switch l.state {
+            case lexWhitespace:
+                return Token{}, io.EOF
+            case lexWord:
+                tok := l.emit(TokenRegular)
+                l.state = lexWhitespace
+                return tok, nil
+            case lexString:
+                return Token{}, &LexError{Pos: l.tokenStart, Msg: "unterminated double-quoted string"}
+            case lexLiteral:
+                return Token{}, &LexError{Pos: l.tokenStart, Msg: "unterminated single-quoted string"}
+            case lexBackslash:
+                return Token{}, &LexError{Pos: start, Msg: "unterminated escape sequence"}
+            }
+        }
+
+        switch l.state {
+        case lexWhitespace:
+            switch {
+            case char == '"':
+                l.tokenStart = start
+                l.state = lexString
+            case char == '\'':
+                l.tokenStart = start
+                l.state = lexLiteral
+            case char == ' ' || char == '\n' || char == '\t':
+                l.state = lexWhitespace
+            case char == '\\':
+                l.lastState = lexWord
+                l.state = lexBackslash
+            case char == '#':
+                text, err := l.scanComment(start)
+                if err != nil {
+                    return Token{}, err
+                }
+                if l.IgnoreComments {
+                    l.state = lexWhitespace
+                    continue
+                }
+                return Token{Type: TokenComment, Value: text, Pos: start}, nil
+            case char == '`':
+                inner, err := l.scanBacktick(start)
+                if err != nil {
+                    return Token{}, err
+                }
+                return l.flushThen(Token{Type: TokenSubshell, Value: inner, Pos: start})
+            case char == '$':
+                res, err := l.handleDollar(start)
+                if err != nil {
+                    return Token{}, err
+                }
+                if res.subshell != nil {
+                    return l.flushThen(*res.subshell)
+                }
+                l.tokenStart = start
+                l.state = lexWord
+                for _, c := range res.expansion {
+                    l.push(c, start)
+                }
+            case isOperatorStart(char):
+                tok, err := l.scanOperator(char, start)
+                if err != nil {
+                    return Token{}, err
+                }
+                return l.flushThen(tok)
+            default:
+                l.push(char, start)
+                l.state = lexWord
+            }
+        case lexWord:
+            switch {
+            case char == ' ' || char == '\n' || char == '\t':
+                tok := l.emit(TokenRegular)
+                l.state = lexWhitespace
+                return tok, nil
+            case char == '"':
+                l.state = lexString
+            case char == '\'':
+                l.state = lexLiteral
+            case char == '\\':
+                l.lastState = l.state
+                l.state = lexBackslash
+            case char == '`':
+                inner, err := l.scanBacktick(start)
+                if err != nil {
+                    return Token{}, err
+                }
+                return l.flushThen(Token{Type: TokenSubshell, Value: inner, Pos: start})
+            case char == '$':
+                res, err := l.handleDollar(start)
+                if err != nil {
+                    return Token{}, err
+                }
+                if res.subshell != nil {
+                    return l.flushThen(*res.subshell)
+                }
+                for _, c := range res.expansion {
+                    l.push(c, start)
+                }
+            case isOperatorStart(char):
+                tok, err := l.scanOperator(char, start)
+                if err != nil {
+                    return Token{}, err
+                }
+                return l.flushThen(tok)
+            default:
+                l.push(char, start)
+            }
+        case lexString:
+            switch {
+            case char == '"':
+                tok := l.emit(TokenRegular)
+                l.state = lexWhitespace
+                return tok, nil
+            case char == '\\':
+                l.lastState = l.state
+                l.state = lexBackslash
+            case char == '$' && l.Env != nil:
+                res, err := l.handleDollar(start)
+                if err != nil {
+                    return Token{}, err
+                }
+                if res.subshell != nil {
+                    // $(...) isn't evaluated, so fold it back in as the
+                    // literal text it came from rather than splitting the
+                    // string into multiple tokens around it.
+                    l.push('$', start)
+                    l.push('(', start)
+                    for _, c := range res.subshell.Value {
+                        l.push(c, start)
+                    }
+                    l.push(')', start)
+                }
+                for _, c := range res.expansion {
+                    l.push(c, start)
+                }
+            default:
+                l.push(char, start)
+            }
+        case lexLiteral:
+            switch char {
+            case '\'':
+                tok := l.emit(TokenLiteral)
+                l.state = lexWhitespace
+                return tok, nil
+            case '\\':
+                l.lastState = l.state
+                l.state = lexBackslash
+            default:
+                l.push(char, start)
+            }
+        case lexBackslash:
+            switch char {
+            case 'n':
+                l.push('\n', start)
+            case 'r':
+                l.push('\r', start)
+            case 't':
+                l.push('\t', start)
+            case 'b':
+                l.push('\b', start)
+            case 'f':
+                l.push('\f', start)
+            case 'v':
+                l.push('\v', start)
+            case 'x':
+                digits, err := l.readDigits(start, 2, isHexDigit, `\x`)
+                if err != nil {
+                    return Token{}, err
+                }
+                v, _ := strconv.ParseUint(digits, 16, 32)
+                l.push(rune(v), start)
+            case 'u':
+                digits, err := l.readDigits(start, 4, isHexDigit, `\u`)
+                if err != nil {
+                    return Token{}, err
+                }
+                v, _ := strconv.ParseUint(digits, 16, 32)
+                if v >= 0xD800 && v <= 0xDFFF {
+                    return Token{}, &LexError{Pos: start, Msg: fmt.Sprintf(`\u escape: %04X is a surrogate half, not a valid code point`, v)}
+                }
+                l.push(rune(v), start)
+            case 'U':
+                digits, err := l.readDigits(start, 8, isHexDigit, `\U`)
+                if err != nil {
+                    return Token{}, err
+                }
+                v, _ := strconv.ParseUint(digits, 16, 32)
+                if v > utf8.MaxRune {
+                    return Token{}, &LexError{Pos: start, Msg: fmt.Sprintf(`\U escape: %08X is not a valid code point`, v)}
+                }
+                l.push(rune(v), start)
+            case '0':
+                digits, err := l.readDigits(start, 3, isOctalDigit, `\0`)
+                if err != nil {
+                    return Token{}, err
+                }
+                v, _ := strconv.ParseUint(digits, 8, 32)
+                l.push(rune(v), start)
+            default:
+                l.push(char, start)
+            }
+            l.state = l.lastState
+        }
+    }
+}
+
+// Peeker wraps a Lexer to allow one token of lookahead without consuming it.
+type Peeker struct {
+    lex *Lexer
+    tok Token
+    err error
+    has bool
+}
+
+// NewPeeker wraps lex so its tokens can be peeked before being consumed.
+func NewPeeker(lex *Lexer) *Peeker {
+    return &Peeker{lex: lex}
+}
+
+// Peek returns the next token (or error) without consuming it. Calling Peek
+// or Next again before the token is consumed returns the same result.
+func (p *Peeker) Peek() (Token, error) {
+    if !p.has {
+        p.tok, p.err = p.lex.Next()
+        p.has = true
+    }
+    return p.tok, p.err
+}
+
+// Next consumes and returns the next token, first peeking at it if Peek
+// hasn't already been called.
+func (p *Peeker) Next() (Token, error) {
+    tok, err := p.Peek()
+    p.has = false
+    return tok, err
+}
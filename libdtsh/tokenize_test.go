@@ -0,0 +1,311 @@
+package dtsh
+
+import (
+    "strings"
+    "testing"
+)
+
+// lexAll drains lex until Next returns an error, returning every token seen
+// and the final error (io.EOF on clean input).
+func lexAll(lex *Lexer) ([]Token, error) {
+    var toks []Token
+    for {
+        tok, err := lex.Next()
+        if err != nil {
+            return toks, err
+        }
+        toks = append(toks, tok)
+    }
+}
+
+func TestTokenizeWords(t *testing.T) {
+    tokens := Tokenize(`foo "bar baz" 'qux'`)
+    want := []struct {
+        typ TokenType
+        val string
+    }{
+        {TokenRegular, "foo"},
+        {TokenRegular, "bar baz"},
+        {TokenLiteral, "qux"},
+    }
+    if len(tokens) != len(want) {
+        t.Fatalf("got %d tokens, want %d: %v", len(tokens), len(want), tokens)
+    }
+    for i, w := range want {
+        if tokens[i].Type != w.typ || tokens[i].Value != w.val {
+            t.Errorf("token %d = %+v, want {%v %q}", i, tokens[i], w.typ, w.val)
+        }
+    }
+}
+
+func TestLexerPositions(t *testing.T) {
+    lex := NewLexer(strings.NewReader("foo\nbar baz"))
+    tokens, err := lexAll(lex)
+    if err == nil {
+        t.Fatalf("expected io.EOF, got nil")
+    }
+    want := []Position{{1, 1}, {2, 1}, {2, 5}}
+    if len(tokens) != len(want) {
+        t.Fatalf("got %d tokens, want %d: %v", len(tokens), len(want), tokens)
+    }
+    for i, pos := range want {
+        if tokens[i].Pos != pos {
+            t.Errorf("token %d (%q) at %v, want %v", i, tokens[i].Value, tokens[i].Pos, pos)
+        }
+    }
+}
+
+func TestPeeker(t *testing.T) {
+    p := NewPeeker(NewLexer(strings.NewReader("foo bar")))
+
+    peeked, err := p.Peek()
+    if err != nil || peeked.Value != "foo" {
+        t.Fatalf("Peek() = %+v, %v, want token %q", peeked, err, "foo")
+    }
+    if again, err := p.Peek(); err != nil || again != peeked {
+        t.Fatalf("second Peek() = %+v, %v, want the same unconsumed token %+v", again, err, peeked)
+    }
+
+    got, err := p.Next()
+    if err != nil || got != peeked {
+        t.Fatalf("Next() after Peek() = %+v, %v, want the peeked token %+v", got, err, peeked)
+    }
+
+    next, err := p.Next()
+    if err != nil || next.Value != "bar" {
+        t.Fatalf("Next() = %+v, %v, want token %q", next, err, "bar")
+    }
+}
+
+func TestTokenizeWithEnv(t *testing.T) {
+    env := map[string]string{"FOO": "bar", "?": "0"}
+    lookup := func(name string) (string, bool) {
+        v, ok := env[name]
+        return v, ok
+    }
+    tests := []struct {
+        in   string
+        want string
+    }{
+        {`$FOO`, "bar"},
+        {`${FOO}baz`, "barbaz"},
+        {`exit=$?`, "exit=0"},
+        {`$MISSING`, ""},
+        {`\$FOO`, "$FOO"},
+    }
+    for _, tt := range tests {
+        tokens := TokenizeWithEnv(tt.in, lookup)
+        if len(tokens) != 1 || tokens[0].Value != tt.want {
+            t.Errorf("TokenizeWithEnv(%q) = %v, want single token %q", tt.in, tokens, tt.want)
+        }
+    }
+}
+
+func TestTokenizeWithEnvSubshellInString(t *testing.T) {
+    // Regression test: a literal $(...) inside a double-quoted string must
+    // not be mistaken for a $NAME reference once Env is set.
+    env := func(name string) (string, bool) { return "", false }
+    tokens := TokenizeWithEnv(`"$(echo hi)"`, env)
+    if len(tokens) != 1 || tokens[0].Value != "$(echo hi)" {
+        t.Errorf(`TokenizeWithEnv(%q) = %v, want single token %q`, `"$(echo hi)"`, tokens, "$(echo hi)")
+    }
+}
+
+func TestLexerOperators(t *testing.T) {
+    lex := NewLexer(strings.NewReader("foo|bar&&baz||qux;quux&a<b>c>>d"))
+    tokens, err := lexAll(lex)
+    if err == nil {
+        t.Fatalf("expected io.EOF, got nil")
+    }
+    want := []struct {
+        typ TokenType
+        val string
+    }{
+        {TokenRegular, "foo"},
+        {TokenPipe, "|"},
+        {TokenRegular, "bar"},
+        {TokenAnd, "&&"},
+        {TokenRegular, "baz"},
+        {TokenOr, "||"},
+        {TokenRegular, "qux"},
+        {TokenSemicolon, ";"},
+        {TokenRegular, "quux"},
+        {TokenBackground, "&"},
+        {TokenRegular, "a"},
+        {TokenRedirIn, "<"},
+        {TokenRegular, "b"},
+        {TokenRedirOut, ">"},
+        {TokenRegular, "c"},
+        {TokenRedirAppend, ">>"},
+        {TokenRegular, "d"},
+    }
+    if len(tokens) != len(want) {
+        t.Fatalf("got %d tokens, want %d: %v", len(tokens), len(want), tokens)
+    }
+    for i, w := range want {
+        if tokens[i].Type != w.typ || tokens[i].Value != w.val {
+            t.Errorf("token %d = %+v, want {%v %q}", i, tokens[i], w.typ, w.val)
+        }
+    }
+}
+
+func TestLexerSubshell(t *testing.T) {
+    tests := []struct {
+        in   string
+        want string
+    }{
+        {"`echo hi`", "echo hi"},
+        {"$(echo hi)", "echo hi"},
+        {"$(echo $(echo hi))", "echo $(echo hi)"},
+    }
+    for _, tt := range tests {
+        tokens := Tokenize(tt.in)
+        if len(tokens) != 1 || tokens[0].Type != TokenSubshell || tokens[0].Value != tt.want {
+            t.Errorf("Tokenize(%q) = %v, want single TokenSubshell %q", tt.in, tokens, tt.want)
+        }
+    }
+}
+
+func TestLexerNewlineIsWhitespace(t *testing.T) {
+    // Regression test: lines in rc-file-style input must not glue together
+    // across a newline, and a '#' right after one must still start a
+    // comment.
+    lex := NewLexer(strings.NewReader("set foo bar\nset baz qux\n# comment line\nset last one\n"))
+    tokens, err := lexAll(lex)
+    if err == nil {
+        t.Fatalf("expected io.EOF, got nil")
+    }
+    want := []string{"set", "foo", "bar", "set", "baz", "qux", " comment line", "set", "last", "one"}
+    if len(tokens) != len(want) {
+        t.Fatalf("got %d tokens, want %d: %v", len(tokens), len(want), tokens)
+    }
+    for i, val := range want {
+        if tokens[i].Value != val {
+            t.Errorf("token %d = %q, want %q", i, tokens[i].Value, val)
+        }
+    }
+    if tokens[6].Type != TokenComment {
+        t.Errorf("token 6 = %v, want TokenComment", tokens[6].Type)
+    }
+}
+
+func TestLexerComment(t *testing.T) {
+    tests := []struct {
+        in   string
+        want []Token
+    }{
+        {"# a comment", []Token{{TokenComment, " a comment", Position{1, 1}}}},
+        {"foo # a comment", []Token{
+            {TokenRegular, "foo", Position{1, 1}},
+            {TokenComment, " a comment", Position{1, 5}},
+        }},
+        {"foo#bar", []Token{{TokenRegular, "foo#bar", Position{1, 1}}}},
+        {`"#not a comment"`, []Token{{TokenRegular, "#not a comment", Position{1, 2}}}},
+    }
+    for _, tt := range tests {
+        tokens := Tokenize(tt.in)
+        if len(tokens) != len(tt.want) {
+            t.Fatalf("Tokenize(%q) = %v, want %v", tt.in, tokens, tt.want)
+        }
+        for i, want := range tt.want {
+            if tokens[i] != want {
+                t.Errorf("Tokenize(%q) token %d = %+v, want %+v", tt.in, i, tokens[i], want)
+            }
+        }
+    }
+}
+
+func TestLexerIgnoreComments(t *testing.T) {
+    lex := NewLexer(strings.NewReader("foo # a comment\nbar"))
+    lex.IgnoreComments = true
+    tokens, err := lexAll(lex)
+    if err == nil {
+        t.Fatalf("expected io.EOF, got nil")
+    }
+    want := []string{"foo", "bar"}
+    if len(tokens) != len(want) {
+        t.Fatalf("got %d tokens, want %d: %v", len(tokens), len(want), tokens)
+    }
+    for i, val := range want {
+        if tokens[i].Value != val {
+            t.Errorf("token %d = %q, want %q", i, tokens[i].Value, val)
+        }
+        if tokens[i].Type == TokenComment {
+            t.Errorf("token %d is a TokenComment, want it suppressed", i)
+        }
+    }
+}
+
+func TestLexerHexEscape(t *testing.T) {
+    tests := []struct {
+        in   string
+        want string
+    }{
+        {`\x41`, "A"},
+        {`"\x41"`, "A"},
+        {`'\x41'`, "A"}, // backslash escapes apply in every state, single quotes only disable $ substitution
+    }
+    for _, tt := range tests {
+        tokens := Tokenize(tt.in)
+        if len(tokens) != 1 || tokens[0].Value != tt.want {
+            t.Errorf("Tokenize(%q) = %v, want single token %q", tt.in, tokens, tt.want)
+        }
+    }
+}
+
+func TestLexerUnicodeEscape(t *testing.T) {
+    tests := []struct {
+        in   string
+        want string
+    }{
+        {`\u0041`, "A"},
+        {`\U00000041`, "A"},
+        {`\0101`, "A"}, // octal 101 == 65 == 'A'
+    }
+    for _, tt := range tests {
+        tokens := Tokenize(tt.in)
+        if len(tokens) != 1 || tokens[0].Value != tt.want {
+            t.Errorf("Tokenize(%q) = %v, want single token %q", tt.in, tokens, tt.want)
+        }
+    }
+}
+
+func TestLexerLeadingBackslashEscape(t *testing.T) {
+    // Regression test: an escape as the very first character of a bare word
+    // must still be decoded, not pushed as a literal backslash.
+    tests := []struct {
+        in   string
+        want string
+    }{
+        {`\n`, "\n"},
+        {`\x41`, "A"},
+    }
+    for _, tt := range tests {
+        tokens := Tokenize(tt.in)
+        if len(tokens) != 1 || tokens[0].Value != tt.want {
+            t.Errorf("Tokenize(%q) = %v, want single token %q", tt.in, tokens, tt.want)
+        }
+    }
+}
+
+func TestLexerEscapeErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        in   string
+    }{
+        {"hex cut short at end of input", `\x4`},
+        {"hex at end of input", `\x`},
+        {"unicode surrogate half", `\uD800`},
+        {"unicode out of range", `\U00110000`},
+        {"bad hex digit", `\x4g`},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            lex := NewLexer(strings.NewReader(tt.in))
+            _, err := lex.Next()
+            if _, ok := err.(*LexError); !ok {
+                t.Errorf("Next() on %q returned %v (%T), want a *LexError", tt.in, err, err)
+            }
+        })
+    }
+}